@@ -0,0 +1,223 @@
+/*
+ * Copyright 2013-2016 Fabian Groffen
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	cfg "github.com/alyu/configparser"
+)
+
+// ingestConfig bundles everything the line, pickle and UDP listeners need
+// to turn a wire-format point into a whisper write.
+type ingestConfig struct {
+	pool         *writerPool
+	maxLineLen   int
+	maxMetricLen int
+	maxPickleLen int
+	rateLimits   []*RateLimit
+	tracker      *connTracker
+}
+
+// RateLimit caps how many points matching pattern a single TCP connection
+// may submit per second; it is configured the same way storage-schemas.conf
+// is, so operators already know the format.
+type RateLimit struct {
+	name    string
+	pattern *regexp.Regexp
+	rate    int
+}
+
+func readRateLimits(file string) ([]*RateLimit, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	config, err := cfg.Read(file)
+	if err != nil {
+		return nil, err
+	}
+
+	sections, err := config.AllSections()
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*RateLimit
+	for _, s := range sections {
+		var rl RateLimit
+		rl.name = strings.Trim(strings.SplitN(s.String(), "\n", 2)[0], " []")
+		if rl.name == "" {
+			continue
+		}
+		rl.pattern, err = regexp.Compile(s.ValueOf("pattern"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse pattern '%s' for [%s]: %s",
+				s.ValueOf("pattern"), rl.name, err.Error())
+		}
+		rl.rate, err = strconv.Atoi(s.ValueOf("rate"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rate '%s' for [%s]: %s",
+				s.ValueOf("rate"), rl.name, err.Error())
+		}
+
+		netLog.Logf("adding rate limit [%s] pattern = %s rate = %d/s",
+			rl.name, s.ValueOf("pattern"), rl.rate)
+		ret = append(ret, &rl)
+	}
+
+	return ret, nil
+}
+
+// connRateLimiter enforces per-connection rate limits for whichever
+// RateLimit rules match the metrics seen on that connection. It is not
+// safe for concurrent use; each connection gets its own instance.
+type connRateLimiter struct {
+	rules       []*RateLimit
+	counts      []int
+	windowStart time.Time
+}
+
+func newConnRateLimiter(rules []*RateLimit) *connRateLimiter {
+	return &connRateLimiter{rules: rules, counts: make([]int, len(rules)), windowStart: time.Now()}
+}
+
+// allow reports whether metric may be accepted, bumping the relevant
+// rule's counter. Metrics matching no rule are always allowed.
+func (c *connRateLimiter) allow(metric string) bool {
+	if len(c.rules) == 0 {
+		return true
+	}
+
+	if now := time.Now(); now.Sub(c.windowStart) >= time.Second {
+		for i := range c.counts {
+			c.counts[i] = 0
+		}
+		c.windowStart = now
+	}
+
+	for i, r := range c.rules {
+		if r.pattern.MatchString(metric) {
+			c.counts[i]++
+			return c.counts[i] <= r.rate
+		}
+	}
+	return true
+}
+
+// readBoundedLine reads up to the next '\n' like bufio.Reader.ReadBytes,
+// but never buffers more than maxLen bytes: once that cap is hit it keeps
+// draining the underlying stream up to the newline (so the connection
+// stays in sync) without growing line further, and reports tooLong.
+func readBoundedLine(r *bufio.Reader, maxLen int) (line []byte, tooLong bool, err error) {
+	for {
+		frag, e := r.ReadSlice('\n')
+		if !tooLong && len(line)+len(frag) <= maxLen {
+			line = append(line, frag...)
+		} else {
+			tooLong = true
+		}
+		if e != bufio.ErrBufferFull {
+			err = e
+			break
+		}
+	}
+	return line, tooLong, err
+}
+
+// parseMetricLine validates and decodes a single "metric value timestamp"
+// line, truncating over-long metric names rather than dropping the point.
+func parseMetricLine(line []byte, maxMetricLen int) (metric string, value float64, ts int, ok bool) {
+	elems := strings.Split(strings.TrimRight(string(line), "\n"), " ")
+	if len(elems) != 3 {
+		netLog.Logf("invalid line: %s", string(line))
+		return "", 0, 0, false
+	}
+
+	metric = elems[0]
+	if metric == "" {
+		netLog.Logf("invalid line: %s", string(line))
+		return "", 0, 0, false
+	}
+	if len(metric) > maxMetricLen {
+		netLog.Logf("truncating over-long metric name (%d bytes): %s...", len(metric), metric[:maxMetricLen])
+		metric = metric[:maxMetricLen]
+	}
+
+	value, err := strconv.ParseFloat(elems[1], 64)
+	if err != nil {
+		netLog.Logf("invalue value '%s': %s", elems[1], err.Error())
+		return "", 0, 0, false
+	}
+
+	tsf, err := strconv.ParseFloat(elems[2], 64)
+	if err != nil {
+		netLog.Logf("invalid timestamp '%s': %s", elems[2], err.Error())
+		return "", 0, 0, false
+	}
+	ts = int(tsf)
+	if ts == 0 {
+		netLog.Logf("invalid timestamp (0): %s", string(line))
+		return "", 0, 0, false
+	}
+
+	return metric, value, ts, true
+}
+
+// handleUDPDatagram feeds every line of a single UDP datagram through the
+// same validation pipeline as handleConnection. UDP is connectionless, so
+// per-connection rate limiting doesn't apply here; the caller is expected
+// to track this call in ic.tracker so shutdown can wait for it.
+func handleUDPDatagram(data []byte, ic *ingestConfig) {
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if len(line) > ic.maxLineLen {
+			netLog.Logf("udp: dropping line of %d bytes (max %d)", len(line), ic.maxLineLen)
+			Metrics.LinesDroppedTooLong.Add(1)
+			continue
+		}
+
+		metric, value, ts, ok := parseMetricLine(line, ic.maxMetricLen)
+		if !ok {
+			continue
+		}
+
+		netLog.Debugf("udp metric: %s, value: %f, ts: %d", metric, value, ts)
+
+		// pool.submit only sends metric onto a worker's channel; the actual
+		// whisper write happens later in writerWorker.flush, which has its
+		// own recover. This guard is just against a send racing shutdown()
+		// closing that channel.
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					netLog.Logf("dropping point for %s: %v", metric, r)
+				}
+			}()
+			ic.pool.submit(metricPoint{metric: metric, ts: ts, value: value})
+		}()
+		Metrics.MetricsReceived.Add(1)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2013-2016 Fabian Groffen
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadBoundedLineWithinLimit(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("servers.a.cpu 1 1000\n"))
+
+	line, tooLong, err := readBoundedLine(r, 64)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tooLong {
+		t.Errorf("expected tooLong = false")
+	}
+	if string(line) != "servers.a.cpu 1 1000\n" {
+		t.Errorf("got %q", line)
+	}
+}
+
+func TestReadBoundedLineOverLimit(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("abcdefghij\n"))
+
+	line, tooLong, err := readBoundedLine(r, 5)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !tooLong {
+		t.Errorf("expected tooLong = true")
+	}
+	if len(line) != 0 {
+		t.Errorf("expected an over-long line to be dropped, got %q", line)
+	}
+}
+
+// TestReadBoundedLineStaysInSync checks that an over-long line is drained up
+// to its newline rather than left half-consumed, so the next call sees the
+// following line rather than the tail of the rejected one.
+func TestReadBoundedLineStaysInSync(t *testing.T) {
+	// the first line is longer than bufio's smallest buffer (16 bytes), which
+	// forces ReadSlice to hit bufio.ErrBufferFull repeatedly while draining it.
+	r := bufio.NewReaderSize(strings.NewReader(strings.Repeat("a", 40)+"\nok\n"), 16)
+
+	_, tooLong, err := readBoundedLine(r, 3)
+	if err != nil {
+		t.Fatalf("unexpected error on first line: %v", err)
+	}
+	if !tooLong {
+		t.Errorf("expected first line to be reported tooLong")
+	}
+
+	line, tooLong, err := readBoundedLine(r, 3)
+	if err != nil {
+		t.Fatalf("unexpected error on second line: %v", err)
+	}
+	if tooLong {
+		t.Errorf("expected second line to fit")
+	}
+	if string(line) != "ok\n" {
+		t.Errorf("stream out of sync: got %q, want %q", line, "ok\n")
+	}
+}
+
+func TestReadBoundedLineEOF(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader(""))
+
+	_, _, err := readBoundedLine(r, 64)
+	if err != io.EOF {
+		t.Errorf("got err = %v, want io.EOF", err)
+	}
+}
+
+func TestReadBoundedLineAcrossBufferFullChunks(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 20)
+	r := bufio.NewReaderSize(strings.NewReader(string(payload)+"\n"), 8)
+
+	line, tooLong, err := readBoundedLine(r, 100)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if tooLong {
+		t.Errorf("expected tooLong = false")
+	}
+	if string(line) != string(payload)+"\n" {
+		t.Errorf("line was not reassembled across buffer-full chunks: got %q", line)
+	}
+}
+
+func TestConnRateLimiterAllow(t *testing.T) {
+	rules := []*RateLimit{
+		{name: "cpu", pattern: regexp.MustCompile(`^servers\.a\.cpu$`), rate: 2},
+	}
+	c := newConnRateLimiter(rules)
+
+	if !c.allow("servers.a.cpu") {
+		t.Errorf("1st point should be allowed")
+	}
+	if !c.allow("servers.a.cpu") {
+		t.Errorf("2nd point should be allowed")
+	}
+	if c.allow("servers.a.cpu") {
+		t.Errorf("3rd point should be denied, rate is 2/s")
+	}
+	if !c.allow("servers.b.cpu") {
+		t.Errorf("metric matching no rule should always be allowed")
+	}
+}
+
+func TestConnRateLimiterWindowReset(t *testing.T) {
+	rules := []*RateLimit{
+		{name: "cpu", pattern: regexp.MustCompile(".*"), rate: 1},
+	}
+	c := newConnRateLimiter(rules)
+
+	if !c.allow("servers.a.cpu") {
+		t.Errorf("1st point should be allowed")
+	}
+	if c.allow("servers.a.cpu") {
+		t.Errorf("2nd point in the same window should be denied")
+	}
+
+	// simulate the window having elapsed
+	c.windowStart = c.windowStart.Add(-2 * time.Second)
+	if !c.allow("servers.a.cpu") {
+		t.Errorf("point in a new window should be allowed again")
+	}
+}
+
+func TestConnRateLimiterNoRules(t *testing.T) {
+	c := newConnRateLimiter(nil)
+	for i := 0; i < 5; i++ {
+		if !c.allow("servers.a.cpu") {
+			t.Errorf("point %d: with no rules everything should be allowed", i)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright 2013-2016 Fabian Groffen
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog"
+)
+
+// subsystem loggers: each carries its own level, independently of the
+// others, so e.g. whisper writes can be traced without drowning in
+// accept-loop chatter.
+var (
+	netLog      = newSubLogger("network")
+	whisperLog  = newSubLogger("whisper")
+	schemaLog   = newSubLogger("schema")
+	aggrLog     = newSubLogger("aggregation")
+	graphiteLog = newSubLogger("graphite")
+)
+
+var baseLogger zerolog.Logger
+
+var subsystemLevels = struct {
+	mu     sync.RWMutex
+	levels map[string]zerolog.Level
+}{levels: make(map[string]zerolog.Level)}
+
+// setupLogging opens the log file under logdir (mirroring mlog.SetOutput's
+// naming) and optionally tees to stdout.
+func setupLogging(logdir, prog string, tostdout bool) error {
+	var w io.Writer
+	if logdir != "" {
+		if err := os.MkdirAll(logdir, os.ModeDir|os.ModePerm); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(filepath.Join(logdir, prog+".log"),
+			os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	if tostdout || w == nil {
+		if w == nil {
+			w = os.Stdout
+		} else {
+			w = io.MultiWriter(w, os.Stdout)
+		}
+	}
+
+	baseLogger = zerolog.New(w).With().Timestamp().Logger()
+	return nil
+}
+
+// subLogger is a cheap handle on a named subsystem; its level is looked up
+// on every call so it reflects runtime changes made via /loglevel.
+type subLogger struct {
+	name string
+}
+
+func newSubLogger(name string) subLogger {
+	subsystemLevels.mu.Lock()
+	subsystemLevels.levels[name] = zerolog.InfoLevel
+	subsystemLevels.mu.Unlock()
+	return subLogger{name: name}
+}
+
+func getSubsystemLevel(name string) zerolog.Level {
+	subsystemLevels.mu.RLock()
+	defer subsystemLevels.mu.RUnlock()
+	return subsystemLevels.levels[name]
+}
+
+// setSubsystemLevel updates the level for an already-registered subsystem.
+// It returns false if name isn't a known subsystem.
+func setSubsystemLevel(name string, lvl zerolog.Level) bool {
+	subsystemLevels.mu.Lock()
+	defer subsystemLevels.mu.Unlock()
+	if _, ok := subsystemLevels.levels[name]; !ok {
+		return false
+	}
+	subsystemLevels.levels[name] = lvl
+	return true
+}
+
+func (s subLogger) log(lvl zerolog.Level, msg string) {
+	if lvl < getSubsystemLevel(s.name) {
+		return
+	}
+	baseLogger.WithLevel(lvl).Str("subsystem", s.name).Msg(msg)
+}
+
+func (s subLogger) Debugf(format string, args ...interface{}) {
+	s.log(zerolog.DebugLevel, fmt.Sprintf(format, args...))
+}
+
+func (s subLogger) Logf(format string, args ...interface{}) {
+	s.log(zerolog.InfoLevel, fmt.Sprintf(format, args...))
+}
+
+func (s subLogger) Errorf(format string, args ...interface{}) {
+	s.log(zerolog.ErrorLevel, fmt.Sprintf(format, args...))
+}
+
+// logLevelHandler lets operators inspect and change per-subsystem log
+// levels at runtime, without a restart: GET lists current levels, POST
+// with subsystem=<name>&level=<level> changes one.
+func logLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		subsystemLevels.mu.RLock()
+		defer subsystemLevels.mu.RUnlock()
+		for name, lvl := range subsystemLevels.levels {
+			fmt.Fprintf(w, "%s=%s\n", name, lvl.String())
+		}
+
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := r.FormValue("subsystem")
+		lvl, err := zerolog.ParseLevel(r.FormValue("level"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid level %q: %s", r.FormValue("level"), err), http.StatusBadRequest)
+			return
+		}
+		if !setSubsystemLevel(name, lvl) {
+			http.Error(w, fmt.Sprintf("unknown subsystem %q", name), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "%s=%s\n", name, lvl.String())
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
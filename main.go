@@ -18,6 +18,8 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/binary"
 	"expvar"
 	"flag"
 	"fmt"
@@ -27,17 +29,19 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	cfg "github.com/alyu/configparser"
-	"github.com/dgryski/carbonzipper/mlog"
 	"github.com/dgryski/httputil"
 	whisper "github.com/grobian/go-whisper"
 	g2g "github.com/peterbourgon/g2g"
+	"github.com/rs/zerolog"
 )
 
 var config = struct {
@@ -49,94 +53,143 @@ var config = struct {
 
 // grouped expvars for /debug/vars and graphite
 var Metrics = struct {
-	MetricsReceived *expvar.Int
+	MetricsReceived       *expvar.Int
+	PickleMetricsReceived *expvar.Int
+	PointsBuffered        *expvar.Int
+	PointsFlushed         *expvar.Int
+	FlushErrors           *expvar.Int
+	LinesDroppedTooLong   *expvar.Int
+	LinesDroppedRateLimit *expvar.Int
 }{
-	MetricsReceived: expvar.NewInt("metrics_received"),
+	MetricsReceived:       expvar.NewInt("metrics_received"),
+	PickleMetricsReceived: expvar.NewInt("pickle_metrics_received"),
+	PointsBuffered:        expvar.NewInt("points_buffered"),
+	PointsFlushed:         expvar.NewInt("points_flushed"),
+	FlushErrors:           expvar.NewInt("flush_errors"),
+	LinesDroppedTooLong:   expvar.NewInt("lines_dropped_too_long"),
+	LinesDroppedRateLimit: expvar.NewInt("lines_dropped_rate_limit"),
 }
 
 var BuildVersion = "(development build)"
 
-var logger mlog.Level
-
-func handleConnection(conn net.Conn, schemas []*StorageSchema, aggrs []*StorageAggregation) {
+func handleConnection(conn net.Conn, ic *ingestConfig) {
 	bufconn := bufio.NewReader(conn)
+	limiter := newConnRateLimiter(ic.rateLimits)
 
 	for {
-		line, err := bufconn.ReadBytes('\n')
+		line, tooLong, err := readBoundedLine(bufconn, ic.maxLineLen)
+		if tooLong {
+			netLog.Logf("dropping over-long line (max %d bytes)", ic.maxLineLen)
+			Metrics.LinesDroppedTooLong.Add(1)
+		}
 		if err != nil {
 			conn.Close()
 			if err != io.EOF {
-				logger.Logf("read failed: %s", err.Error())
+				netLog.Logf("read failed: %s", err.Error())
 			}
 			break
 		}
-
-		elems := strings.Split(string(line), " ")
-		if len(elems) != 3 {
-			logger.Logf("invalid line: %s", string(line))
+		if tooLong {
 			continue
 		}
 
-		metric := elems[0]
+		metric, value, ts, ok := parseMetricLine(line, ic.maxMetricLen)
+		if !ok {
+			continue
+		}
 
-		value, err := strconv.ParseFloat(elems[1], 64)
-		if err != nil {
-			logger.Logf("invalue value '%s': %s", elems[1], err.Error())
+		if !limiter.allow(metric) {
+			netLog.Logf("rate limit exceeded for %s, dropping point", metric)
+			Metrics.LinesDroppedRateLimit.Add(1)
 			continue
 		}
 
-		elems[2] = strings.TrimRight(elems[2], "\n")
-		tsf, err := strconv.ParseFloat(elems[2], 64)
+		netLog.Debugf("metric: %s, value: %f, ts: %d", metric, value, ts)
+
+		// pool.submit only sends metric onto a worker's channel; the actual
+		// whisper write happens later in writerWorker.flush, which has its
+		// own recover. This guard is just against a send racing shutdown()
+		// closing that channel, wrapped per-point so the defer doesn't pile
+		// up for the lifetime of the connection.
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					netLog.Logf("dropping point for %s: %v", metric, r)
+					if err := conn.Close(); err != nil {
+						netLog.Logf("error while closing connection after send panic: %v", err)
+					}
+				}
+			}()
+			ic.pool.submit(metricPoint{metric: metric, ts: ts, value: value})
+		}()
+		Metrics.MetricsReceived.Add(1)
+	}
+}
+
+// handlePickleConnection implements the Graphite "pickle" protocol: each
+// message is a 4-byte big-endian length prefix followed by a pickled list
+// of (metric, (timestamp, value)) tuples, as emitted by carbon-relay and
+// carbon-c-relay.
+func handlePickleConnection(conn net.Conn, ic *ingestConfig) {
+	bufconn := bufio.NewReader(conn)
+
+	for {
+		var lenbuf [4]byte
+		_, err := io.ReadFull(bufconn, lenbuf[:])
 		if err != nil {
-			logger.Logf("invalid timestamp '%s': %s", elems[2], err.Error())
-			continue
+			conn.Close()
+			if err != io.EOF {
+				netLog.Logf("pickle: read failed: %s", err.Error())
+			}
+			break
+		}
+		length := binary.BigEndian.Uint32(lenbuf[:])
+		if length > uint32(ic.maxPickleLen) {
+			netLog.Logf("pickle: payload of %d bytes exceeds max %d, dropping connection", length, ic.maxPickleLen)
+			conn.Close()
+			break
 		}
-		ts := int(tsf)
 
-		if metric == "" {
-			logger.Logf("invalid line: %s", string(line))
-			continue
+		payload := make([]byte, length)
+		_, err = io.ReadFull(bufconn, payload)
+		if err != nil {
+			netLog.Logf("pickle: failed to read %d byte payload: %s", length, err.Error())
+			conn.Close()
+			break
 		}
 
-		if ts == 0 {
-			logger.Logf("invalid timestamp (0): %s", string(line))
+		metrics, err := decodePickle(payload)
+		if err != nil {
+			netLog.Logf("pickle: failed to decode payload: %s", err.Error())
 			continue
 		}
 
-		logger.Debugf("metric: %s, value: %f, ts: %d", metric, value, ts)
-
-		// catch panics from whisper-go library
-		defer func() {
-			if r := recover(); r != nil {
-				logger.Logf("recovering from whisper panic (metric: %s): %v", metric, r)
-				err := conn.Close()
-				if err != nil {
-					logger.Logf("error while closing connection after whisper panic: %v", err)
-				}
-			}
-		}()
-
-		// do what we want to do
-		path := config.WhisperData + "/" + strings.Replace(metric, ".", "/", -1) + ".wsp"
-		w, err := whisper.Open(path)
-		if err != nil && os.IsNotExist(err) {
-			w = createMetric(metric, path, schemas, aggrs)
-			if w == nil {
+		for _, m := range metrics {
+			if m.metric == "" || m.ts == 0 {
+				netLog.Logf("pickle: invalid metric: %+v", m)
 				continue
 			}
-		} else if err != nil {
-			// some other error
-			logger.Logf("failed to open whisper file %s: %v", path, err)
-			continue
-		}
 
-		err = w.Update(value, int(ts))
-		if err != nil {
-			logger.Logf("failed to update whisper file %s: %v", path, err)
+			netLog.Debugf("pickle metric: %s, value: %f, ts: %d", m.metric, m.value, m.ts)
+
+			// pool.submit only sends metric onto a worker's channel; the actual
+			// whisper write happens later in writerWorker.flush, which has its
+			// own recover. This guard is just against a send racing shutdown()
+			// closing that channel, wrapped per-point so the defer doesn't pile
+			// up for the lifetime of the connection.
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						netLog.Logf("dropping point for %s: %v", m.metric, r)
+						if err := conn.Close(); err != nil {
+							netLog.Logf("error while closing connection after send panic: %v", err)
+						}
+					}
+				}()
+				ic.pool.submit(metricPoint{metric: m.metric, ts: m.ts, value: m.value})
+			}()
+			Metrics.PickleMetricsReceived.Add(1)
 		}
-		w.Close()
-
-		Metrics.MetricsReceived.Add(1)
 	}
 }
 
@@ -149,10 +202,10 @@ func createMetric(metric, path string, schemas []*StorageSchema, aggrs []*Storag
 		}
 	}
 	if schema == nil {
-		logger.Logf("no storage schema defined for %s", metric)
+		whisperLog.Logf("no storage schema defined for %s", metric)
 		return nil
 	}
-	logger.Debugf("%s: found schema: %s", metric, schema.name)
+	whisperLog.Debugf("%s: found schema: %s", metric, schema.name)
 
 	var aggr *StorageAggregation
 	for _, a := range aggrs {
@@ -174,7 +227,7 @@ func createMetric(metric, path string, schemas []*StorageSchema, aggrs []*Storag
 		xfilesf = float32(aggr.xFilesFactor)
 	}
 
-	logger.Logf("creating %s: %s, retention: %s (section %s), aggregationMethod: %s, xFilesFactor: %f (section %s)",
+	whisperLog.Logf("creating %s: %s, retention: %s (section %s), aggregationMethod: %s, xFilesFactor: %f (section %s)",
 		metric, path, schema.retentionStr, schema.name,
 		aggrStr, xfilesf, aggrName)
 
@@ -184,34 +237,114 @@ func createMetric(metric, path string, schemas []*StorageSchema, aggrs []*Storag
 		dir := path[0:lastslash]
 		err := os.MkdirAll(dir, os.ModeDir|os.ModePerm)
 		if err != nil {
-			logger.Logf("error during mkdir(%q): %v\n", dir, err)
+			whisperLog.Logf("error during mkdir(%q): %v\n", dir, err)
 			return nil
 		}
 
 	}
 	w, err := whisper.Create(path, schema.retentions, aggrType, xfilesf)
 	if err != nil {
-		logger.Logf("failed to create new whisper file %s: %v", path, err)
+		whisperLog.Logf("failed to create new whisper file %s: %v", path, err)
 		return nil
 	}
 
 	return w
 }
 
-func listenAndServe(listen string, schemas []*StorageSchema, aggrs []*StorageAggregation) {
+// listenAndServe binds listen synchronously and registers it with
+// ic.tracker before returning, so a shutdown signal arriving right after
+// this call is guaranteed to see (and close) the listener; only the
+// blocking accept loop itself runs in a background goroutine.
+func listenAndServe(listen string, ic *ingestConfig, handler func(net.Conn, *ingestConfig)) {
 	l, err := net.Listen("tcp", listen)
 	if err != nil {
-		logger.Logf("failed to listen on %s: %s", listen, err.Error())
+		netLog.Logf("failed to listen on %s: %s", listen, err.Error())
 		os.Exit(1)
 	}
+	ic.tracker.addListener(l)
+	go acceptConnections(l, ic, handler)
+}
+
+// listenAndServeTLS is identical to listenAndServe, except connections are
+// wrapped in TLS using the given certificate before being handed to
+// handler; it's meant for handleConnection, so graphite agents that can't
+// reach us over a plain TCP line can still get encryption in transit.
+func listenAndServeTLS(listen, certFile, keyFile string, ic *ingestConfig, handler func(net.Conn, *ingestConfig)) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		netLog.Logf("failed to load TLS certificate %s / key %s: %s", certFile, keyFile, err.Error())
+		os.Exit(1)
+	}
+
+	l, err := tls.Listen("tcp", listen, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		netLog.Logf("failed to listen on %s: %s", listen, err.Error())
+		os.Exit(1)
+	}
+	ic.tracker.addListener(l)
+	go acceptConnections(l, ic, handler)
+}
+
+func acceptConnections(l net.Listener, ic *ingestConfig, handler func(net.Conn, *ingestConfig)) {
 	defer l.Close()
 	for {
 		conn, err := l.Accept()
 		if err != nil {
-			logger.Logf("failed to accept connection: %s", err.Error())
+			if ic.tracker.isClosing() {
+				return
+			}
+			netLog.Logf("failed to accept connection: %s", err.Error())
 			continue
 		}
-		go handleConnection(conn, schemas, aggrs)
+		ic.tracker.wg.Add(1)
+		go func() {
+			defer ic.tracker.wg.Done()
+			handler(conn, ic)
+		}()
+	}
+}
+
+// listenAndServeUDP binds listen synchronously and registers it with
+// ic.tracker before returning, for the same shutdown-race reason as
+// listenAndServe; only the blocking read loop runs in a background
+// goroutine. UDP is connectionless and unordered, so there's no
+// per-connection state (and no rate limiting) here; each datagram's handler
+// goroutine is still tracked in ic.tracker so shutdown can wait for it.
+func listenAndServeUDP(listen string, ic *ingestConfig) {
+	addr, err := net.ResolveUDPAddr("udp", listen)
+	if err != nil {
+		netLog.Logf("failed to resolve UDP address %s: %s", listen, err.Error())
+		os.Exit(1)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		netLog.Logf("failed to listen on %s: %s", listen, err.Error())
+		os.Exit(1)
+	}
+	ic.tracker.addListener(conn)
+	go udpReadLoop(conn, ic)
+}
+
+func udpReadLoop(conn *net.UDPConn, ic *ingestConfig) {
+	defer conn.Close()
+
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ic.tracker.isClosing() {
+				return
+			}
+			netLog.Logf("udp: read failed: %s", err.Error())
+			continue
+		}
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		ic.tracker.wg.Add(1)
+		go func() {
+			defer ic.tracker.wg.Done()
+			handleUDPDatagram(datagram, ic)
+		}()
 	}
 }
 
@@ -245,21 +378,69 @@ func readStorageSchemas(file string) ([]*StorageSchema, error) {
 		}
 		sschema.pattern, err = regexp.Compile(s.ValueOf("pattern"))
 		if err != nil {
-			logger.Logf("failed to parse pattern '%s'for [%s]: %s",
+			return nil, fmt.Errorf("failed to parse pattern '%s' for [%s]: %s",
 				s.ValueOf("pattern"), sschema.name, err.Error())
-			continue
 		}
 		sschema.retentionStr = s.ValueOf("retentions")
 		sschema.retentions, err = whisper.ParseRetentionDefs(sschema.retentionStr)
-		logger.Debugf("adding schema [%s] pattern = %s retentions = %s",
-			sschema.name, s.ValueOf("pattern"), sschema.retentionStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse retentions '%s' for [%s]: %s",
+				sschema.retentionStr, sschema.name, err.Error())
+		}
+		if len(sschema.retentions) == 0 {
+			return nil, fmt.Errorf("[%s] defines no retentions", sschema.name)
+		}
 
 		ret = append(ret, &sschema)
 	}
 
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no storage schemas defined in %s", file)
+	}
+
+	catchAll := false
+	for _, s := range ret {
+		if isCatchAllPattern(s.pattern) {
+			catchAll = true
+			break
+		}
+	}
+	if !catchAll {
+		return nil, fmt.Errorf("no catch-all schema (e.g. pattern = .*) defined in %s; "+
+			"metrics matching no schema would be silently dropped", file)
+	}
+
+	schemaLog.Logf("storage schemas loaded from %s, in match order:", file)
+	for _, s := range ret {
+		schemaLog.Logf("  [%s] pattern=%s retentions=%s", s.name, s.pattern.String(), s.retentionStr)
+	}
+
 	return ret, nil
 }
 
+// catchAllProbes are matched against every schema pattern to detect a true
+// catch-all (e.g. ".*") entry. regexp.MatchString is unanchored, so a
+// single fixed probe string can be fooled by a narrower pattern that
+// merely happens to appear as a substring of it (e.g. pattern = "carbon").
+// Requiring a match against several differently-shaped, unrelated probes
+// makes that false positive astronomically unlikely while still passing
+// for any pattern that genuinely matches everything.
+var catchAllProbes = []string{
+	"zzz.schema-validation-probe.9f3a1c7e",
+	"a",
+	"123.456.789",
+	"unrelated_metric_name_xyz",
+}
+
+func isCatchAllPattern(pattern *regexp.Regexp) bool {
+	for _, probe := range catchAllProbes {
+		if !pattern.MatchString(probe) {
+			return false
+		}
+	}
+	return true
+}
+
 type StorageAggregation struct {
 	name                 string
 	pattern              *regexp.Regexp
@@ -291,13 +472,13 @@ func readStorageAggregations(file string) ([]*StorageAggregation, error) {
 		}
 		saggr.pattern, err = regexp.Compile(s.ValueOf("pattern"))
 		if err != nil {
-			logger.Logf("failed to parse pattern '%s'for [%s]: %s",
+			aggrLog.Logf("failed to parse pattern '%s'for [%s]: %s",
 				s.ValueOf("pattern"), saggr.name, err.Error())
 			continue
 		}
 		saggr.xFilesFactor, err = strconv.ParseFloat(s.ValueOf("xFilesFactor"), 64)
 		if err != nil {
-			logger.Logf("failed to parse xFilesFactor '%s' in %s: %s",
+			aggrLog.Logf("failed to parse xFilesFactor '%s' in %s: %s",
 				s.ValueOf("xFilesFactor"), saggr.name, err.Error())
 			continue
 		}
@@ -315,12 +496,12 @@ func readStorageAggregations(file string) ([]*StorageAggregation, error) {
 		case "min":
 			saggr.aggregationMethod = whisper.Min
 		default:
-			logger.Logf("unknown aggregation method '%s'",
+			aggrLog.Logf("unknown aggregation method '%s'",
 				s.ValueOf("aggregationMethod"))
 			continue
 		}
 
-		logger.Debugf("adding aggregation [%s] pattern = %s aggregationMethod = %s xFilesFactor = %f",
+		aggrLog.Debugf("adding aggregation [%s] pattern = %s aggregationMethod = %s xFilesFactor = %f",
 			saggr.name, s.ValueOf("pattern"),
 			saggr.aggregationMethodStr, saggr.xFilesFactor)
 		ret = append(ret, &saggr)
@@ -331,6 +512,7 @@ func readStorageAggregations(file string) ([]*StorageAggregation, error) {
 
 func main() {
 	port := flag.Int("p", 2003, "port to bind to")
+	pickleport := flag.Int("pickleport", 2004, "port to bind to for the pickle protocol")
 	reportport := flag.Int("reportport", 8080, "port to bind http report interface to")
 	verbose := flag.Bool("v", false, "enable verbose logging")
 	debug := flag.Bool("vv", false, "enable more verbose (debug) logging")
@@ -340,43 +522,87 @@ func main() {
 	schemafile := flag.String("schemafile", "/etc/carbon/storage-schemas.conf", "storage-schemas.conf location")
 	aggrfile := flag.String("aggrfile", "/etc/carbon/storage-aggregation.conf", "storage-aggregation.conf location")
 	logtostdout := flag.Bool("stdout", false, "log also to stdout")
+	writers := flag.Int("writers", 8, "number of whisper writer goroutines")
+	writerlru := flag.Int("writerlru", 256, "number of open whisper handles kept per writer")
+	flushmax := flag.Int("flushmax", 500, "flush a metric's buffered points after this many points")
+	flushinterval := flag.Duration("flushinterval", time.Second, "flush buffered points for all metrics at this interval")
+	lognetwork := flag.String("log.network", "", "log level for the network subsystem (debug, info, warn, error, trace)")
+	logwhisper := flag.String("log.whisper", "", "log level for the whisper subsystem")
+	logschema := flag.String("log.schema", "", "log level for the schema subsystem")
+	logaggregation := flag.String("log.aggregation", "", "log level for the aggregation subsystem")
+	loggraphite := flag.String("log.graphite", "", "log level for the graphite subsystem")
+	udpport := flag.Int("udpport", 0, "port to bind to for the line protocol over UDP (0 disables UDP)")
+	tlsport := flag.Int("tlsport", 0, "port to bind to for the line protocol over TLS (0 disables TLS)")
+	tlscert := flag.String("tlscert", "", "TLS certificate file (required if -tlsport is set)")
+	tlskey := flag.String("tlskey", "", "TLS private key file (required if -tlsport is set)")
+	maxlinelen := flag.Int("maxlinelen", 8192, "maximum accepted line length in bytes; longer lines are dropped")
+	maxmetriclen := flag.Int("maxmetriclen", 4096, "maximum accepted metric name length in bytes; longer names are truncated")
+	maxpicklelen := flag.Int("maxpicklelen", 1<<20, "maximum accepted pickle payload length in bytes; oversized payloads drop the connection")
+	ratelimitfile := flag.String("ratelimitfile", "", "optional per-connection rate limit rules, storage-schemas.conf style")
+	shutdowntimeout := flag.Duration("shutdowntimeout", 30*time.Second,
+		"how long to wait for in-flight connections to drain on SIGTERM/SIGINT before exiting anyway")
 
 	flag.Parse()
 
-	mlog.SetOutput(*logdir, "carbonwriter", *logtostdout)
+	if err := setupLogging(*logdir, "carbonwriter", *logtostdout); err != nil {
+		log.Fatalf("failed to set up logging in %s: %s", *logdir, err)
+	}
 
 	expvar.NewString("BuildVersion").Set(BuildVersion)
 	log.Println("starting carbonwriter", BuildVersion)
 
-	loglevel := mlog.Normal
+	defaultLevel := zerolog.InfoLevel
 	if *verbose {
-		loglevel = mlog.Debug
+		defaultLevel = zerolog.DebugLevel
 	}
 	if *debug {
-		loglevel = mlog.Trace
+		defaultLevel = zerolog.TraceLevel
 	}
 
-	logger = mlog.Level(loglevel)
+	for name, flagVal := range map[string]string{
+		"network":     *lognetwork,
+		"whisper":     *logwhisper,
+		"schema":      *logschema,
+		"aggregation": *logaggregation,
+		"graphite":    *loggraphite,
+	} {
+		lvl := defaultLevel
+		if flagVal != "" {
+			parsed, err := zerolog.ParseLevel(flagVal)
+			if err != nil {
+				log.Fatalf("invalid -log.%s level %q: %s", name, flagVal, err)
+			}
+			lvl = parsed
+		}
+		setSubsystemLevel(name, lvl)
+	}
+	http.HandleFunc("/loglevel", logLevelHandler)
 
 	schemas, err := readStorageSchemas(*schemafile)
 	if err != nil {
-		logger.Logf("failed to read %s: %s", *schemafile, err.Error())
+		schemaLog.Logf("failed to read %s: %s", *schemafile, err.Error())
 		os.Exit(1)
 	}
 
 	aggrs, err := readStorageAggregations(*aggrfile)
 	if err != nil {
-		logger.Logf("failed to read %s: %s", *aggrfile, err.Error())
+		aggrLog.Logf("failed to read %s: %s", *aggrfile, err.Error())
+		os.Exit(1)
+	}
+
+	rateLimits, err := readRateLimits(*ratelimitfile)
+	if err != nil {
+		netLog.Logf("failed to read %s: %s", *ratelimitfile, err.Error())
 		os.Exit(1)
 	}
 
 	config.WhisperData = strings.TrimRight(*whisperdata, "/")
-	logger.Logf("writing whisper files to: %s", config.WhisperData)
-	logger.Logf("reading storage schemas from: %s", *schemafile)
-	logger.Logf("reading aggregation rules from: %s", *aggrfile)
+	whisperLog.Logf("writing whisper files to: %s", config.WhisperData)
+	schemaLog.Logf("reading storage schemas from: %s", *schemafile)
+	aggrLog.Logf("reading aggregation rules from: %s", *aggrfile)
 
 	runtime.GOMAXPROCS(*maxprocs)
-	logger.Logf("set GOMAXPROCS=%d", *maxprocs)
+	log.Printf("set GOMAXPROCS=%d", *maxprocs)
 
 	httputil.PublishTrackedConnections("httptrack")
 
@@ -390,7 +616,7 @@ func main() {
 	// only register g2g if we have a graphite host
 	if config.GraphiteHost != "" {
 
-		logger.Logf("Using graphite host %v", config.GraphiteHost)
+		graphiteLog.Logf("using graphite host %v", config.GraphiteHost)
 
 		// register our metrics with graphite
 		graphite, err := g2g.NewGraphite(config.GraphiteHost, 60*time.Second, 10*time.Second)
@@ -404,13 +630,58 @@ func main() {
 		graphite.Register(fmt.Sprintf("carbon.writer.%s.metricsReceived", hostname), Metrics.MetricsReceived)
 	}
 
+	pool := newWriterPool(*writers, *writerlru, *flushmax, *flushinterval, schemas, aggrs)
+	whisperLog.Logf("started %d whisper writers, lru=%d, flushmax=%d, flushinterval=%s",
+		*writers, *writerlru, *flushmax, *flushinterval)
+
+	tracker := &connTracker{}
+	ic := &ingestConfig{
+		pool:         pool,
+		maxLineLen:   *maxlinelen,
+		maxMetricLen: *maxmetriclen,
+		maxPickleLen: *maxpicklelen,
+		rateLimits:   rateLimits,
+		tracker:      tracker,
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigc {
+			if sig == syscall.SIGHUP {
+				reloadConfig(*schemafile, *aggrfile, pool)
+				continue
+			}
+			netLog.Logf("received %s, shutting down", sig)
+			gracefulShutdown(tracker, pool, *shutdowntimeout)
+		}
+	}()
+
 	listen := fmt.Sprintf(":%d", *port)
+	picklelisten := fmt.Sprintf(":%d", *pickleport)
 	httplisten := fmt.Sprintf(":%d", *reportport)
-	logger.Logf("listening on %s, statistics via %s", listen, httplisten)
-	go listenAndServe(listen, schemas, aggrs)
+	netLog.Logf("listening on %s (line), %s (pickle), statistics via %s", listen, picklelisten, httplisten)
+	listenAndServe(listen, ic, handleConnection)
+	listenAndServe(picklelisten, ic, handlePickleConnection)
+
+	if *udpport != 0 {
+		udplisten := fmt.Sprintf(":%d", *udpport)
+		netLog.Logf("listening on %s (line, UDP)", udplisten)
+		listenAndServeUDP(udplisten, ic)
+	}
+
+	if *tlsport != 0 {
+		if *tlscert == "" || *tlskey == "" {
+			log.Fatalf("-tlsport requires both -tlscert and -tlskey")
+		}
+		tlslisten := fmt.Sprintf(":%d", *tlsport)
+		netLog.Logf("listening on %s (line, TLS)", tlslisten)
+		listenAndServeTLS(tlslisten, *tlscert, *tlskey, ic, handleConnection)
+	}
+
 	err = http.ListenAndServe(httplisten, nil)
 	if err != nil {
 		log.Fatalf("%s", err)
 	}
-	logger.Logf("stopped")
+	log.Println("stopped")
 }
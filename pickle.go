@@ -0,0 +1,361 @@
+/*
+ * Copyright 2013-2016 Fabian Groffen
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// pickleMetric is a single (metric, (timestamp, value)) tuple as sent by
+// carbon-relay / carbon-c-relay over the pickle protocol.
+type pickleMetric struct {
+	metric string
+	ts     int
+	value  float64
+}
+
+// pickle opcodes we understand; this is intentionally not a full pickle
+// implementation, just enough to decode the list-of-tuples payload that
+// carbon-relay and carbon-c-relay emit. GLOBAL and REDUCE are explicitly
+// rejected rather than ignored, since supporting them would mean executing
+// arbitrary "build a class instance" instructions from the network.
+const (
+	opMark           = '('
+	opStop           = '.'
+	opPop            = '0'
+	opEmptyList      = ']'
+	opAppend         = 'a'
+	opAppends        = 'e'
+	opTuple          = 't'
+	opTuple1         = 0x85
+	opTuple2         = 0x86
+	opTuple3         = 0x87
+	opShortBinstring = 'U'
+	opBinunicode     = 'X'
+	opBinint         = 'J'
+	opBinint1        = 'K'
+	opBinint2        = 'M'
+	opLong1          = 0x8a
+	opBinfloat       = 'G'
+	opProto          = 0x80
+	opGlobal         = 'c'
+	opReduce         = 'R'
+	opBinput         = 'q'
+	opLongBinput     = 'r'
+	opBinget         = 'h'
+	opLongBinget     = 'j'
+)
+
+// markType is pushed onto the value stack to mark the position of a MARK
+// opcode, so TUPLE/APPENDS know where their operands start.
+type markType struct{}
+
+var mark = markType{}
+
+// decodePickle interprets the opcodes in data and returns the decoded list
+// of metric tuples. It implements only the subset of pickle protocol 2
+// needed to represent `[(metric, (timestamp, value)), ...]`.
+func decodePickle(data []byte) ([]pickleMetric, error) {
+	var stack []interface{}
+	memo := make(map[uint32]interface{})
+	pos := 0
+
+	need := func(n int) error {
+		if pos+n > len(data) {
+			return fmt.Errorf("pickle: truncated payload at offset %d", pos)
+		}
+		return nil
+	}
+
+	for pos < len(data) {
+		op := data[pos]
+		pos++
+
+		switch op {
+		case opProto:
+			if err := need(1); err != nil {
+				return nil, err
+			}
+			pos++ // protocol version, we don't care
+
+		case opMark:
+			stack = append(stack, mark)
+
+		case opEmptyList:
+			stack = append(stack, []interface{}{})
+
+		case opPop:
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("pickle: POP on empty stack")
+			}
+			stack = stack[:len(stack)-1]
+
+		case opAppend, opAppends:
+			var items []interface{}
+			if op == opAppends {
+				i := len(stack) - 1
+				for i >= 0 && stack[i] != mark {
+					i--
+				}
+				if i < 0 {
+					return nil, fmt.Errorf("pickle: APPENDS without MARK")
+				}
+				items = append(items, stack[i+1:]...)
+				stack = stack[:i]
+			} else {
+				if len(stack) == 0 {
+					return nil, fmt.Errorf("pickle: APPEND on empty stack")
+				}
+				items = append(items, stack[len(stack)-1])
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("pickle: APPEND(S) without list")
+			}
+			lst, ok := stack[len(stack)-1].([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("pickle: APPEND(S) target is not a list")
+			}
+			stack[len(stack)-1] = append(lst, items...)
+
+		case opTuple:
+			i := len(stack) - 1
+			for i >= 0 && stack[i] != mark {
+				i--
+			}
+			if i < 0 {
+				return nil, fmt.Errorf("pickle: TUPLE without MARK")
+			}
+			items := append([]interface{}{}, stack[i+1:]...)
+			stack = append(stack[:i], items)
+
+		case opTuple1:
+			if len(stack) < 1 {
+				return nil, fmt.Errorf("pickle: TUPLE1 on short stack")
+			}
+			a := stack[len(stack)-1]
+			stack = append(stack[:len(stack)-1], []interface{}{a})
+
+		case opTuple2:
+			if len(stack) < 2 {
+				return nil, fmt.Errorf("pickle: TUPLE2 on short stack")
+			}
+			a, b := stack[len(stack)-2], stack[len(stack)-1]
+			stack = append(stack[:len(stack)-2], []interface{}{a, b})
+
+		case opTuple3:
+			if len(stack) < 3 {
+				return nil, fmt.Errorf("pickle: TUPLE3 on short stack")
+			}
+			a, b, c := stack[len(stack)-3], stack[len(stack)-2], stack[len(stack)-1]
+			stack = append(stack[:len(stack)-3], []interface{}{a, b, c})
+
+		case opShortBinstring:
+			if err := need(1); err != nil {
+				return nil, err
+			}
+			n := int(data[pos])
+			pos++
+			if err := need(n); err != nil {
+				return nil, err
+			}
+			stack = append(stack, string(data[pos:pos+n]))
+			pos += n
+
+		case opBinunicode:
+			if err := need(4); err != nil {
+				return nil, err
+			}
+			n := int(binary.LittleEndian.Uint32(data[pos : pos+4]))
+			pos += 4
+			if err := need(n); err != nil {
+				return nil, err
+			}
+			stack = append(stack, string(data[pos:pos+n]))
+			pos += n
+
+		case opBinint:
+			if err := need(4); err != nil {
+				return nil, err
+			}
+			v := int32(binary.LittleEndian.Uint32(data[pos : pos+4]))
+			pos += 4
+			stack = append(stack, int(v))
+
+		case opBinint1:
+			if err := need(1); err != nil {
+				return nil, err
+			}
+			stack = append(stack, int(data[pos]))
+			pos++
+
+		case opBinint2:
+			if err := need(2); err != nil {
+				return nil, err
+			}
+			v := binary.LittleEndian.Uint16(data[pos : pos+2])
+			pos += 2
+			stack = append(stack, int(v))
+
+		case opLong1:
+			if err := need(1); err != nil {
+				return nil, err
+			}
+			n := int(data[pos])
+			pos++
+			if err := need(n); err != nil {
+				return nil, err
+			}
+			stack = append(stack, decodeLong1(data[pos:pos+n]))
+			pos += n
+
+		case opBinfloat:
+			if err := need(8); err != nil {
+				return nil, err
+			}
+			v := math.Float64frombits(binary.BigEndian.Uint64(data[pos : pos+8]))
+			pos += 8
+			stack = append(stack, v)
+
+		case opBinput:
+			if err := need(1); err != nil {
+				return nil, err
+			}
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("pickle: BINPUT on empty stack")
+			}
+			memo[uint32(data[pos])] = stack[len(stack)-1]
+			pos++
+
+		case opLongBinput:
+			if err := need(4); err != nil {
+				return nil, err
+			}
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("pickle: LONG_BINPUT on empty stack")
+			}
+			memo[binary.LittleEndian.Uint32(data[pos:pos+4])] = stack[len(stack)-1]
+			pos += 4
+
+		case opBinget:
+			if err := need(1); err != nil {
+				return nil, err
+			}
+			v, ok := memo[uint32(data[pos])]
+			if !ok {
+				return nil, fmt.Errorf("pickle: BINGET of unknown memo %d", data[pos])
+			}
+			stack = append(stack, v)
+			pos++
+
+		case opLongBinget:
+			if err := need(4); err != nil {
+				return nil, err
+			}
+			idx := binary.LittleEndian.Uint32(data[pos : pos+4])
+			v, ok := memo[idx]
+			if !ok {
+				return nil, fmt.Errorf("pickle: LONG_BINGET of unknown memo %d", idx)
+			}
+			stack = append(stack, v)
+			pos += 4
+
+		case opGlobal, opReduce:
+			return nil, fmt.Errorf("pickle: rejecting unsafe opcode 0x%x (GLOBAL/REDUCE)", op)
+
+		case opStop:
+			if len(stack) != 1 {
+				return nil, fmt.Errorf("pickle: STOP with stack size %d", len(stack))
+			}
+			return pickleMetricsFromList(stack[0])
+
+		default:
+			return nil, fmt.Errorf("pickle: unsupported opcode 0x%x", op)
+		}
+	}
+
+	return nil, fmt.Errorf("pickle: payload ended without STOP")
+}
+
+// decodeLong1 decodes a pickle LONG1 payload: an arbitrary-precision,
+// little-endian, two's-complement integer. Payloads of up to 8 bytes are
+// decoded exactly; longer ones keep only their low 64 bits.
+func decodeLong1(b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+	var v int64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | int64(b[i])
+	}
+	// sign-extend if the top bit of the most significant byte is set
+	if b[len(b)-1]&0x80 != 0 && len(b) < 8 {
+		v -= 1 << (uint(len(b)) * 8)
+	}
+	return int(v)
+}
+
+// pickleMetricsFromList converts the decoded `[(metric, (ts, value)), ...]`
+// generic list into our typed representation.
+func pickleMetricsFromList(v interface{}) ([]pickleMetric, error) {
+	lst, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("pickle: top-level value is not a list")
+	}
+
+	ret := make([]pickleMetric, 0, len(lst))
+	for _, item := range lst {
+		tuple, ok := item.([]interface{})
+		if !ok || len(tuple) != 2 {
+			return nil, fmt.Errorf("pickle: metric entry is not a 2-tuple")
+		}
+		metric, ok := tuple[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("pickle: metric name is not a string")
+		}
+		datapoint, ok := tuple[1].([]interface{})
+		if !ok || len(datapoint) != 2 {
+			return nil, fmt.Errorf("pickle: datapoint is not a 2-tuple")
+		}
+
+		var ts int
+		switch n := datapoint[0].(type) {
+		case int:
+			ts = n
+		case float64:
+			ts = int(n)
+		default:
+			return nil, fmt.Errorf("pickle: timestamp has unexpected type %T", datapoint[0])
+		}
+
+		var value float64
+		switch n := datapoint[1].(type) {
+		case float64:
+			value = n
+		case int:
+			value = float64(n)
+		default:
+			return nil, fmt.Errorf("pickle: value has unexpected type %T", datapoint[1])
+		}
+
+		ret = append(ret, pickleMetric{metric: metric, ts: ts, value: value})
+	}
+
+	return ret, nil
+}
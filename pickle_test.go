@@ -0,0 +1,194 @@
+/*
+ * Copyright 2013-2016 Fabian Groffen
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func pShortString(s string) []byte {
+	return append([]byte{opShortBinstring, byte(len(s))}, []byte(s)...)
+}
+
+func pBinint(v int32) []byte {
+	b := make([]byte, 5)
+	b[0] = opBinint
+	binary.LittleEndian.PutUint32(b[1:], uint32(v))
+	return b
+}
+
+func pBinfloat(v float64) []byte {
+	b := make([]byte, 9)
+	b[0] = opBinfloat
+	binary.BigEndian.PutUint64(b[1:], math.Float64bits(v))
+	return b
+}
+
+func pBinput(idx byte) []byte { return []byte{opBinput, idx} }
+func pBinget(idx byte) []byte { return []byte{opBinget, idx} }
+func concat(parts ...[]byte) []byte {
+	var out []byte
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// pEntry builds the bytes for a single (metric, (ts, value)) tuple, leaving
+// it as the new top-of-stack item.
+func pEntry(metric string, ts int32, value float64) []byte {
+	return concat(
+		pShortString(metric),
+		pBinint(ts),
+		pBinfloat(value),
+		[]byte{opTuple2},
+		[]byte{opTuple2},
+	)
+}
+
+func TestDecodePickleSingleMetric(t *testing.T) {
+	payload := concat(
+		[]byte{opProto, 2},
+		[]byte{opEmptyList},
+		pEntry("servers.a.cpu", 1000, 42.5),
+		[]byte{opAppend},
+		[]byte{opStop},
+	)
+
+	metrics, err := decodePickle(payload)
+	if err != nil {
+		t.Fatalf("decodePickle: unexpected error: %v", err)
+	}
+	if len(metrics) != 1 {
+		t.Fatalf("expected 1 metric, got %d", len(metrics))
+	}
+	want := pickleMetric{metric: "servers.a.cpu", ts: 1000, value: 42.5}
+	if metrics[0] != want {
+		t.Errorf("got %+v, want %+v", metrics[0], want)
+	}
+}
+
+func TestDecodePickleMultipleMetricsViaAppends(t *testing.T) {
+	payload := concat(
+		[]byte{opEmptyList},
+		[]byte{opMark},
+		pEntry("servers.a.cpu", 1000, 1),
+		pEntry("servers.b.cpu", 2000, 2),
+		[]byte{opAppends},
+		[]byte{opStop},
+	)
+
+	metrics, err := decodePickle(payload)
+	if err != nil {
+		t.Fatalf("decodePickle: unexpected error: %v", err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(metrics))
+	}
+	if metrics[0].metric != "servers.a.cpu" || metrics[1].metric != "servers.b.cpu" {
+		t.Errorf("unexpected metrics: %+v", metrics)
+	}
+}
+
+// TestDecodePickleMemo exercises BINPUT/BINGET: carbon-relay memoizes
+// repeated metric name strings instead of re-sending them.
+func TestDecodePickleMemo(t *testing.T) {
+	payload := concat(
+		[]byte{opEmptyList},
+		[]byte{opMark},
+		// first entry: push and memoize the metric name at slot 0
+		pShortString("servers.shared.cpu"),
+		pBinput(0),
+		pBinint(1000),
+		pBinfloat(1),
+		[]byte{opTuple2},
+		[]byte{opTuple2},
+		// second entry: recall the memoized name instead of re-sending it
+		pBinget(0),
+		pBinint(2000),
+		pBinfloat(2),
+		[]byte{opTuple2},
+		[]byte{opTuple2},
+		[]byte{opAppends},
+		[]byte{opStop},
+	)
+
+	metrics, err := decodePickle(payload)
+	if err != nil {
+		t.Fatalf("decodePickle: unexpected error: %v", err)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(metrics))
+	}
+	for i, m := range metrics {
+		if m.metric != "servers.shared.cpu" {
+			t.Errorf("metric %d: got name %q, want %q", i, m.metric, "servers.shared.cpu")
+		}
+	}
+	if metrics[0].ts != 1000 || metrics[1].ts != 2000 {
+		t.Errorf("unexpected timestamps: %+v", metrics)
+	}
+}
+
+func TestDecodePickleErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"truncated BININT", []byte{opEmptyList, opBinint, 0x01, 0x02}},
+		{"rejects GLOBAL", []byte{opGlobal}},
+		{"rejects REDUCE", []byte{opReduce}},
+		{"STOP on empty stack", []byte{opStop}},
+		{"unknown opcode", []byte{0xff}},
+		{"BINGET of unknown memo", []byte{opBinget, 0x00}},
+		{"ends without STOP", []byte{opEmptyList}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodePickle(tt.payload); err == nil {
+				t.Errorf("decodePickle(%v): expected error, got nil", tt.payload)
+			}
+		})
+	}
+}
+
+func TestDecodeLong1(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want int
+	}{
+		{"empty", nil, 0},
+		{"single positive byte", []byte{0x05}, 5},
+		{"single byte high bit set is negative", []byte{0xff}, -1},
+		{"two bytes positive", []byte{0xff, 0x7f}, 32767},
+		{"two bytes negative", []byte{0x00, 0x80}, -32768},
+		{"four bytes max positive int32", []byte{0xff, 0xff, 0xff, 0x7f}, 2147483647},
+		{"eight bytes all-ones is -1", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := decodeLong1(tt.in); got != tt.want {
+				t.Errorf("decodeLong1(%v) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+/*
+ * Copyright 2013-2016 Fabian Groffen
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connTracker lets main stop accepting new carbon connections and wait for
+// in-flight handler goroutines to finish before the process exits. A
+// single instance is shared by every listener (TCP, TLS and UDP).
+type connTracker struct {
+	wg sync.WaitGroup
+
+	mu        sync.Mutex
+	listeners []io.Closer
+
+	closing int32
+}
+
+// addListener registers l so stopAccepting can close it later.
+func (t *connTracker) addListener(l io.Closer) {
+	t.mu.Lock()
+	t.listeners = append(t.listeners, l)
+	t.mu.Unlock()
+}
+
+// stopAccepting closes every registered listener, which causes their
+// accept/read loops to fail and return instead of blocking for new
+// connections or datagrams.
+func (t *connTracker) stopAccepting() {
+	atomic.StoreInt32(&t.closing, 1)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, l := range t.listeners {
+		l.Close()
+	}
+}
+
+// isClosing reports whether stopAccepting has been called, so an
+// accept/read loop can tell a deliberate shutdown apart from a transient
+// error.
+func (t *connTracker) isClosing() bool {
+	return atomic.LoadInt32(&t.closing) != 0
+}
+
+// wait blocks until every tracked handler goroutine has returned, or
+// timeout elapses first; it reports whether they all finished in time.
+func (t *connTracker) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// gracefulShutdown stops accepting new carbon connections, waits up to
+// timeout for in-flight handlers to finish, flushes every writer's
+// buffered points and closes its whisper handles, then exits the process.
+//
+// If handlers don't drain within timeout, it exits with status 1 without
+// flushing or closing whisper handles: pool.shutdown() closes each worker's
+// input channel, and
+// a handler goroutine still running past that point would panic trying to
+// submit to it.
+func gracefulShutdown(tracker *connTracker, pool *writerPool, timeout time.Duration) {
+	netLog.Logf("shutting down: no longer accepting new connections")
+	tracker.stopAccepting()
+
+	if !tracker.wait(timeout) {
+		netLog.Logf("timed out after %s waiting for in-flight connections to drain; exiting without a final flush", timeout)
+		os.Exit(1)
+	}
+
+	whisperLog.Logf("flushing buffered points and closing whisper files")
+	pool.shutdown()
+
+	netLog.Logf("shutdown complete")
+	os.Exit(0)
+}
+
+// reloadConfig re-reads storage-schemas.conf and storage-aggregation.conf
+// and, if both parse cleanly, atomically swaps them into pool so every
+// writer worker picks them up for the next whisper file it creates.
+// Existing whisper files are unaffected by a reload: their retention and
+// aggregation method were fixed when they were created. A failure to
+// parse either file leaves the previous rules in place.
+func reloadConfig(schemafile, aggrfile string, pool *writerPool) {
+	schemas, err := readStorageSchemas(schemafile)
+	if err != nil {
+		schemaLog.Logf("SIGHUP: failed to reload %s, keeping previous schemas: %s", schemafile, err.Error())
+		return
+	}
+
+	aggrs, err := readStorageAggregations(aggrfile)
+	if err != nil {
+		aggrLog.Logf("SIGHUP: failed to reload %s, keeping previous aggregations: %s", aggrfile, err.Error())
+		return
+	}
+
+	pool.reload(schemas, aggrs)
+	schemaLog.Logf("SIGHUP: reloaded storage schemas from %s", schemafile)
+	aggrLog.Logf("SIGHUP: reloaded aggregation rules from %s", aggrfile)
+}
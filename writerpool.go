@@ -0,0 +1,262 @@
+/*
+ * Copyright 2013-2016 Fabian Groffen
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	whisper "github.com/grobian/go-whisper"
+)
+
+// metricPoint is a single datapoint waiting to be written to a whisper
+// file.
+type metricPoint struct {
+	metric string
+	ts     int
+	value  float64
+}
+
+// writerPool dispatches incoming points to a fixed set of writer workers,
+// keyed by a hash of the metric name. Since the same metric always lands
+// on the same worker, and each worker is single-threaded, no .wsp file is
+// ever touched by more than one goroutine at a time, and points for a
+// metric can be coalesced into a single UpdateMany call.
+type writerPool struct {
+	workers []*writerWorker
+}
+
+// schemaSet bundles the storage schema and aggregation rules used to
+// create new whisper files; it is swapped as a unit on SIGHUP reload so a
+// worker never sees a schema reloaded without its matching aggregation.
+type schemaSet struct {
+	schemas []*StorageSchema
+	aggrs   []*StorageAggregation
+}
+
+func newWriterPool(workers, lruSize, flushMax int, flushInterval time.Duration,
+	schemas []*StorageSchema, aggrs []*StorageAggregation) *writerPool {
+	cfg := &atomic.Value{}
+	cfg.Store(&schemaSet{schemas: schemas, aggrs: aggrs})
+
+	p := &writerPool{
+		workers: make([]*writerWorker, workers),
+	}
+	for i := range p.workers {
+		w := &writerWorker{
+			id:            i,
+			in:            make(chan metricPoint, flushMax),
+			done:          make(chan struct{}),
+			lru:           newWhisperLRU(lruSize),
+			buffers:       make(map[string][]*whisper.TimeSeriesPoint),
+			flushMax:      flushMax,
+			flushInterval: flushInterval,
+			schemaCfg:     cfg,
+			queueDepth:    expvar.NewInt(fmt.Sprintf("writer_queue_depth_%d", i)),
+		}
+		p.workers[i] = w
+		go w.run()
+	}
+	return p
+}
+
+// submit hands a point to the worker responsible for its metric. It never
+// blocks the caller beyond the worker's queue filling up.
+func (p *writerPool) submit(pt metricPoint) {
+	h := fnv.New32a()
+	h.Write([]byte(pt.metric))
+	idx := h.Sum32() % uint32(len(p.workers))
+	p.workers[idx].in <- pt
+	Metrics.PointsBuffered.Add(1)
+}
+
+// reload atomically swaps the schema and aggregation rules every worker
+// uses to create new whisper files. Whisper files already created keep
+// their existing retention and aggregation method regardless; only
+// metrics seen for the first time after this call use the new rules.
+func (p *writerPool) reload(schemas []*StorageSchema, aggrs []*StorageAggregation) {
+	cfg := &schemaSet{schemas: schemas, aggrs: aggrs}
+	for _, w := range p.workers {
+		w.schemaCfg.Store(cfg)
+	}
+}
+
+// shutdown closes every worker's input channel, which drives each one to
+// flush its buffered points and close its whisper handles, then blocks
+// until all of them have done so.
+func (p *writerPool) shutdown() {
+	for _, w := range p.workers {
+		close(w.in)
+	}
+	for _, w := range p.workers {
+		<-w.done
+	}
+}
+
+// writerWorker owns a bounded set of open whisper handles and a buffer of
+// unflushed points per metric, all touched only from its own run loop.
+type writerWorker struct {
+	id            int
+	in            chan metricPoint
+	done          chan struct{}
+	lru           *whisperLRU
+	buffers       map[string][]*whisper.TimeSeriesPoint
+	flushMax      int
+	flushInterval time.Duration
+	schemaCfg     *atomic.Value // holds *schemaSet, shared across all workers
+	queueDepth    *expvar.Int
+}
+
+func (w *writerWorker) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case pt, ok := <-w.in:
+			if !ok {
+				w.flushAll()
+				w.lru.closeAll()
+				return
+			}
+			w.queueDepth.Set(int64(len(w.in)))
+			w.buffer(pt)
+		case <-ticker.C:
+			w.flushAll()
+		}
+	}
+}
+
+func (w *writerWorker) buffer(pt metricPoint) {
+	points := append(w.buffers[pt.metric], &whisper.TimeSeriesPoint{Time: pt.ts, Value: pt.value})
+	if len(points) >= w.flushMax {
+		w.flush(pt.metric, points)
+		delete(w.buffers, pt.metric)
+		return
+	}
+	w.buffers[pt.metric] = points
+}
+
+func (w *writerWorker) flushAll() {
+	for metric, points := range w.buffers {
+		w.flush(metric, points)
+		delete(w.buffers, metric)
+	}
+}
+
+func (w *writerWorker) flush(metric string, points []*whisper.TimeSeriesPoint) {
+	if len(points) == 0 {
+		return
+	}
+
+	cfg := w.schemaCfg.Load().(*schemaSet)
+	wh, err := w.lru.open(metric, cfg.schemas, cfg.aggrs)
+	if err != nil {
+		whisperLog.Logf("writer %d: failed to open whisper file for %s: %v", w.id, metric, err)
+		Metrics.FlushErrors.Add(1)
+		return
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				whisperLog.Logf("writer %d: recovering from whisper panic flushing %s: %v", w.id, metric, r)
+				Metrics.FlushErrors.Add(1)
+			}
+		}()
+		wh.UpdateMany(points)
+	}()
+
+	Metrics.PointsFlushed.Add(int64(len(points)))
+}
+
+// whisperLRU is a bounded cache of open *whisper.Whisper handles, keyed by
+// metric name. It is not safe for concurrent use; each writerWorker owns
+// its own instance and only ever touches it from its run loop.
+type whisperLRU struct {
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type whisperLRUEntry struct {
+	metric string
+	w      *whisper.Whisper
+}
+
+func newWhisperLRU(size int) *whisperLRU {
+	return &whisperLRU{
+		size:  size,
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+// open returns the (possibly newly created) whisper handle for metric,
+// evicting the least recently used handle if the cache is full.
+func (l *whisperLRU) open(metric string, schemas []*StorageSchema, aggrs []*StorageAggregation) (*whisper.Whisper, error) {
+	if el, ok := l.items[metric]; ok {
+		l.order.MoveToFront(el)
+		return el.Value.(*whisperLRUEntry).w, nil
+	}
+
+	path := whisperPath(metric)
+	w, err := whisper.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		w = createMetric(metric, path, schemas, aggrs)
+		if w == nil {
+			return nil, fmt.Errorf("no storage schema defined for %s", metric)
+		}
+	}
+
+	el := l.order.PushFront(&whisperLRUEntry{metric: metric, w: w})
+	l.items[metric] = el
+
+	if l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		entry := oldest.Value.(*whisperLRUEntry)
+		delete(l.items, entry.metric)
+		entry.w.Close()
+	}
+
+	return w, nil
+}
+
+func (l *whisperLRU) closeAll() {
+	for el := l.order.Front(); el != nil; el = el.Next() {
+		el.Value.(*whisperLRUEntry).w.Close()
+	}
+	l.order.Init()
+	l.items = make(map[string]*list.Element)
+}
+
+// whisperPath returns the on-disk path for metric under config.WhisperData.
+func whisperPath(metric string) string {
+	return config.WhisperData + "/" + strings.Replace(metric, ".", "/", -1) + ".wsp"
+}
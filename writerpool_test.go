@@ -0,0 +1,102 @@
+/*
+ * Copyright 2013-2016 Fabian Groffen
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	whisper "github.com/grobian/go-whisper"
+)
+
+func testCatchAllSchema(t *testing.T) []*StorageSchema {
+	s := &StorageSchema{
+		name:         "catchall",
+		pattern:      regexp.MustCompile(".*"),
+		retentionStr: "60:60",
+	}
+	retentions, err := whisper.ParseRetentionDefs(s.retentionStr)
+	if err != nil {
+		t.Fatalf("ParseRetentionDefs(%q): %v", s.retentionStr, err)
+	}
+	s.retentions = retentions
+	return []*StorageSchema{s}
+}
+
+// TestWhisperLRUEviction checks that the cache evicts the least recently
+// used handle once it grows past its configured size, and that touching an
+// entry moves it back to the front so it survives the next eviction.
+func TestWhisperLRUEviction(t *testing.T) {
+	oldData := config.WhisperData
+	config.WhisperData = t.TempDir()
+	defer func() { config.WhisperData = oldData }()
+
+	schemas := testCatchAllSchema(t)
+	lru := newWhisperLRU(2)
+
+	if _, err := lru.open("metric.one", schemas, nil); err != nil {
+		t.Fatalf("open metric.one: %v", err)
+	}
+	if _, err := lru.open("metric.two", schemas, nil); err != nil {
+		t.Fatalf("open metric.two: %v", err)
+	}
+	// touch metric.one so metric.two becomes the least recently used entry
+	if _, err := lru.open("metric.one", schemas, nil); err != nil {
+		t.Fatalf("re-open metric.one: %v", err)
+	}
+	// a third distinct metric should evict metric.two, not metric.one
+	if _, err := lru.open("metric.three", schemas, nil); err != nil {
+		t.Fatalf("open metric.three: %v", err)
+	}
+
+	if _, ok := lru.items["metric.two"]; ok {
+		t.Errorf("expected metric.two to have been evicted")
+	}
+	if _, ok := lru.items["metric.one"]; !ok {
+		t.Errorf("expected recently touched metric.one to still be cached")
+	}
+	if _, ok := lru.items["metric.three"]; !ok {
+		t.Errorf("expected metric.three to be cached")
+	}
+	if lru.order.Len() != 2 {
+		t.Errorf("expected cache size to stay at 2, got %d", lru.order.Len())
+	}
+}
+
+func TestWhisperLRUReusesOpenHandle(t *testing.T) {
+	oldData := config.WhisperData
+	config.WhisperData = t.TempDir()
+	defer func() { config.WhisperData = oldData }()
+
+	schemas := testCatchAllSchema(t)
+	lru := newWhisperLRU(2)
+
+	w1, err := lru.open("metric.one", schemas, nil)
+	if err != nil {
+		t.Fatalf("open metric.one: %v", err)
+	}
+	w2, err := lru.open("metric.one", schemas, nil)
+	if err != nil {
+		t.Fatalf("re-open metric.one: %v", err)
+	}
+	if w1 != w2 {
+		t.Errorf("expected the same handle to be returned for a cached metric")
+	}
+	if lru.order.Len() != 1 {
+		t.Errorf("expected a single cache entry, got %d", lru.order.Len())
+	}
+}